@@ -0,0 +1,149 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// commits is the process-wide, disk-backed cache of commits known to
+// the builder, across every repository polled by commitPoll. Using a
+// persistent cache instead of an in-memory map means killing and
+// restarting the builder doesn't lose track of which commits were
+// already posted to the dashboard, which used to cause duplicate
+// dashboard posts on restart.
+var commits *commitCache
+
+type cacheKey struct {
+	Pkg, Hash string
+}
+
+// cacheEntry is the persisted form of a Commit: Added is tracked
+// outside Commit's own unexported added field so it survives a
+// round trip through JSON.
+type cacheEntry struct {
+	Key    cacheKey
+	Commit Commit
+	Added  bool
+}
+
+// commitCache is a persistent store of Commits, keyed by (pkg, hash),
+// flushed to a JSON file under *buildroot.
+type commitCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[cacheKey]*cacheEntry
+}
+
+// newCommitCache loads path, if it exists, into a new commitCache.
+func newCommitCache(path string) *commitCache {
+	c := &commitCache{
+		path:    path,
+		entries: make(map[cacheKey]*cacheEntry),
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c
+	}
+	var saved []cacheEntry
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("commitCache: ignoring corrupt cache %s: %v", path, err)
+		return c
+	}
+	for i := range saved {
+		e := saved[i]
+		c.entries[e.Key] = &e
+	}
+	return c
+}
+
+// Get returns the cached commit for (pkg, hash), if known.
+func (c *commitCache) Get(pkg, hash string) (*Commit, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[cacheKey{pkg, hash}]
+	if !ok {
+		return nil, false
+	}
+	l := e.Commit
+	l.added = e.Added
+	return &l, true
+}
+
+// Put records l under (pkg, l.Hash), overwriting any previous entry
+// but preserving its Added bit.
+func (c *commitCache) Put(pkg string, l *Commit) {
+	c.mu.Lock()
+	key := cacheKey{pkg, l.Hash}
+	added := l.added
+	if old, ok := c.entries[key]; ok {
+		added = added || old.Added
+	}
+	c.entries[key] = &cacheEntry{Key: key, Commit: *l, Added: added}
+	c.mu.Unlock()
+}
+
+// MarkAdded records that the commit (pkg, hash) has been posted to
+// the dashboard.
+func (c *commitCache) MarkAdded(pkg, hash string) {
+	c.mu.Lock()
+	if e, ok := c.entries[cacheKey{pkg, hash}]; ok {
+		e.Added = true
+	}
+	c.mu.Unlock()
+}
+
+// Ancestors returns the hashes reachable from (pkg, hash) by
+// following Parent links, nearest ancestor first.
+func (c *commitCache) Ancestors(pkg, hash string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var hashes []string
+	e, ok := c.entries[cacheKey{pkg, hash}]
+	for ok && e.Commit.Parent != "" {
+		hashes = append(hashes, e.Commit.Parent)
+		e, ok = c.entries[cacheKey{pkg, e.Commit.Parent}]
+	}
+	return hashes
+}
+
+// HasAny reports whether the cache holds any commit for pkg, used to
+// decide whether commitPoll is seeing this package for the first time
+// and should backfill -historyDepth revisions of history.
+func (c *commitCache) HasAny(pkg string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k := range c.entries {
+		if k.Pkg == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush writes the cache to disk as JSON.
+func (c *commitCache) Flush() error {
+	c.mu.Lock()
+	saved := make([]cacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		saved = append(saved, *e)
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Clean(c.path))
+}
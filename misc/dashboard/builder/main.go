@@ -25,6 +25,7 @@ const (
 	codeProject      = "go"
 	codePyScript     = "misc/dashboard/googlecode_upload.py"
 	hgUrl            = "https://code.google.com/p/go/"
+	gitUrl           = "https://github.com/golang/go"
 	mkdirPerm        = 0750
 	waitInterval     = 30 * time.Second // time to wait before checking for new revs
 	pkgBuildInterval = 24 * time.Hour   // rebuild packages every 24 hours
@@ -45,6 +46,13 @@ type Builder struct {
 	name         string
 	goos, goarch string
 	key          string
+
+	// lastWorkpath and lastHash record the most recent workpath built
+	// by benchHash, so a nearby revision can reuse it via hg update
+	// instead of paying for a fresh hgClone. The build command still
+	// runs in full on a reused workpath.
+	lastWorkpath string
+	lastHash     string
 }
 
 var (
@@ -53,11 +61,19 @@ var (
 	buildRelease   = flag.Bool("release", false, "Build and upload binary release archives")
 	buildRevision  = flag.String("rev", "", "Build specified revision and exit")
 	buildCmd       = flag.String("cmd", filepath.Join(".", allCmd), "Build command (specify relative to go/src/)")
+	benchMode      = flag.Bool("bench", false, "Run benchmarks instead of the correctness build, and upload PerfResults")
+	benchPkgs      = flag.String("benchpkgs", "", "comma-separated list of packages to benchmark in -bench mode")
+	bisect         = flag.Bool("bisect", false, "Bisect to find the commit that broke a builder (or, in -bench mode, regressed a benchmark) and exit")
+	bisectGood     = flag.String("bisectgood", "", "known-good revision for -bisect (default: builder's last known-good result on the dashboard)")
+	bisectBad      = flag.String("bisectbad", "tip", "known-bad revision for -bisect")
+	bisectSlower   = flag.Float64("bisectslower", 0.05, "in -bench mode, treat a revision as bad if it is this fraction slower than -bisectgood")
 	failAll        = flag.Bool("fail", false, "fail all builds")
 	parallel       = flag.Bool("parallel", false, "Build multiple targets in parallel")
 	buildTimeout   = flag.Duration("buildTimeout", 60*time.Minute, "Maximum time to wait for builds and tests")
 	cmdTimeout     = flag.Duration("cmdTimeout", 5*time.Minute, "Maximum time to wait for an external command")
 	commitInterval = flag.Duration("commitInterval", 1*time.Minute, "Time to wait between polling for new commits")
+	historyDepth   = flag.Int("historyDepth", 0, "on first run for a package, backfill this many revisions of history instead of just the last "+strconv.Itoa(N))
+	reportFormat   = flag.String("reportFormat", "text", `build log format to upload: "text", "json", or "both"`)
 	verbose        = flag.Bool("v", false, "verbose")
 )
 
@@ -89,6 +105,7 @@ func main() {
 		flag.Usage()
 	}
 	goroot = filepath.Join(*buildroot, "goroot")
+	commits = newCommitCache(filepath.Join(*buildroot, "commits.json"))
 	builders := make([]*Builder, len(flag.Args()))
 	for i, builder := range flag.Args() {
 		b, err := NewBuilder(builder)
@@ -104,7 +121,7 @@ func main() {
 	}
 
 	// set up work environment, use existing enviroment if possible
-	if hgRepoExists(goroot) {
+	if mainVCS().Exists(goroot) {
 		log.Print("Found old workspace, will use it")
 	} else {
 		if err := os.RemoveAll(*buildroot); err != nil {
@@ -113,19 +130,34 @@ func main() {
 		if err := os.Mkdir(*buildroot, mkdirPerm); err != nil {
 			log.Fatalf("Error making build root (%s): %s", *buildroot, err)
 		}
-		if err := hgClone(hgUrl, goroot); err != nil {
+		if err := mainVCS().Clone(mainRepoURL(), goroot); err != nil {
 			log.Fatal("Error cloning repository:", err)
 		}
 	}
 
+	if *bisect {
+		for _, b := range builders {
+			if err := b.bisect(); err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
+
 	// if specified, build revision and return
 	if *buildRevision != "" {
-		hash, err := fullHash(goroot, *buildRevision)
+		hash, err := mainVCS().FullHash(goroot, *buildRevision)
 		if err != nil {
 			log.Fatal("Error finding revision: ", err)
 		}
 		for _, b := range builders {
-			if err := b.buildHash(hash); err != nil {
+			var err error
+			if *benchMode {
+				err = b.benchHash(hash)
+			} else {
+				err = b.buildHash(hash)
+			}
+			if err != nil {
 				log.Println(err)
 			}
 		}
@@ -149,7 +181,7 @@ func main() {
 			done := make(chan bool)
 			for _, b := range builders {
 				go func(b *Builder) {
-					done <- b.build()
+					done <- b.buildOrBench()
 				}(b)
 			}
 			for _ = range builders {
@@ -157,7 +189,7 @@ func main() {
 			}
 		} else {
 			for _, b := range builders {
-				built = b.build() || built
+				built = b.buildOrBench() || built
 			}
 		}
 		// sleep if there was nothing to build
@@ -230,14 +262,14 @@ func (b *Builder) build() bool {
 		return false
 	}
 
-	// Look for hash locally before running hg pull.
-	if _, err := fullHash(goroot, hash[:12]); err != nil {
-		// Don't have hash, so run hg pull.
+	// Look for hash locally before pulling new revisions.
+	vcs := mainVCS()
+	if _, err := vcs.FullHash(goroot, hash[:12]); err != nil {
 		gorootMu.Lock()
-		err = run(*cmdTimeout, nil, goroot, hgCmd("pull")...)
+		err = vcs.Pull(goroot)
 		gorootMu.Unlock()
 		if err != nil {
-			log.Println("hg pull failed:", err)
+			log.Println("pull failed:", err)
 			return false
 		}
 	}
@@ -259,17 +291,27 @@ func (b *Builder) buildHash(hash string) error {
 	}
 	defer os.RemoveAll(workpath)
 
+	vcs := mainVCS()
+	goDir := filepath.Join(workpath, "go")
+
 	// clone repo
-	if err := hgClone(goroot, filepath.Join(workpath, "go")); err != nil {
+	cloneStart := time.Now()
+	gorootMu.Lock()
+	err := vcs.Clone(goroot, goDir)
+	gorootMu.Unlock()
+	cloneTime := time.Now().Sub(cloneStart)
+	if err != nil {
 		return err
 	}
 
 	// update to specified revision
-	if err := run(*cmdTimeout, nil, filepath.Join(workpath, "go"), hgCmd("update", hash)...); err != nil {
+	updateStart := time.Now()
+	if err := vcs.Update(goDir, hash); err != nil {
 		return err
 	}
+	updateTime := time.Now().Sub(updateStart)
 
-	srcDir := filepath.Join(workpath, "go", "src")
+	srcDir := filepath.Join(goDir, "src")
 
 	// build
 	logfile := filepath.Join(workpath, "build.log")
@@ -278,15 +320,32 @@ func (b *Builder) buildHash(hash string) error {
 		cmd = filepath.Join(srcDir, cmd)
 	}
 	startTime := time.Now()
-	buildLog, status, err := runLog(*buildTimeout, b.envv(), logfile, srcDir, cmd)
+	buildLog, status, err := b.runBuild(*buildTimeout, workpath, srcDir, logfile, b.envv(), cmd)
 	runTime := time.Now().Sub(startTime)
 	if err != nil {
 		return fmt.Errorf("%s: %s", *buildCmd, err)
 	}
 
+	if *reportFormat != "text" {
+		report := parseBuildReport(b.name, hash, buildLog, status, runTime)
+		report.Phases = append([]BuildPhase{
+			{Name: "clone", Duration: cloneTime},
+			{Name: "update", Duration: updateTime},
+		}, report.Phases...)
+		if err := postBuildReport(b.key, hash, report); err != nil {
+			log.Printf("postBuildReport %s: %v", hash, err)
+		}
+	}
+
 	if status != 0 {
-		// record failure
-		return b.recordResult(false, "", hash, "", buildLog, runTime)
+		// record failure. The raw log is only uploaded when -reportFormat
+		// asks for it; "json" means the structured BuildReport above is
+		// the log.
+		rawLog := buildLog
+		if *reportFormat == "json" {
+			rawLog = ""
+		}
+		return b.recordResult(false, "", hash, "", rawLog, runTime)
 	}
 
 	// record success
@@ -302,6 +361,439 @@ func (b *Builder) buildHash(hash string) error {
 	return nil
 }
 
+// buildOrBench runs the correctness build, or in -bench mode the
+// benchmark run, for this builder. It returns true if a build or
+// bench run was attempted.
+func (b *Builder) buildOrBench() bool {
+	if *benchMode {
+		return b.bench()
+	}
+	return b.build()
+}
+
+// bench checks for a new commit for this builder
+// and benchmarks it if one is found.
+// It returns true if a bench run was attempted.
+func (b *Builder) bench() bool {
+	hash, err := b.todo("build-go-commit", "", "")
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if hash == "" {
+		return false
+	}
+
+	vcs := mainVCS()
+	if _, err := vcs.FullHash(goroot, hash[:12]); err != nil {
+		gorootMu.Lock()
+		err = vcs.Pull(goroot)
+		gorootMu.Unlock()
+		if err != nil {
+			log.Println("pull failed:", err)
+			return false
+		}
+	}
+
+	if err := b.benchHash(hash); err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+// PerfArtifact is a blob of data produced while benchmarking a single
+// revision. runBenchmarks produces only the "go test" output as a
+// "log" artifact; no CPU or memory profiles are collected.
+type PerfArtifact struct {
+	Type string // "log"
+	Body []byte
+}
+
+// PerfResult is the outcome of running a single benchmark at a
+// single revision. It is the performance-dashboard analog of the
+// (ok, pkg, hash, log) tuple recordResult posts for correctness
+// builds.
+type PerfResult struct {
+	Builder   string
+	Hash      string
+	Benchmark string
+	Metrics   map[string]float64 // "ns/op", "B/op", "allocs/op"; RSS and binary size are not measured
+	Artifacts []PerfArtifact
+}
+
+// benchReuseDistance is the maximum number of revisions between two
+// hashes for which benchHash will reuse an existing workpath (via hg
+// update) rather than doing a full hgClone.
+const benchReuseDistance = 20
+
+// benchHash builds the given revision and runs the configured set of
+// benchmarks against it, uploading the results to the dashboard.
+func (b *Builder) benchHash(hash string) error {
+	log.Println(b.name, "benchmarking", hash)
+
+	workpath, isNew, err := b.benchWorkpath(hash)
+	if err != nil {
+		return err
+	}
+	if isNew {
+		defer func() {
+			if b.lastWorkpath != workpath {
+				os.RemoveAll(workpath)
+			}
+		}()
+	}
+
+	// Build the toolchain at this revision before benchmarking it.
+	buildLog, status, runTime, err := b.buildGoTool(workpath)
+	if err != nil {
+		return fmt.Errorf("%s: %s", *buildCmd, err)
+	}
+	if status != 0 {
+		return b.recordResult(false, "", hash, "", buildLog, runTime)
+	}
+
+	results, err := b.runBenchmarks(workpath, hash)
+	if err != nil {
+		return fmt.Errorf("runBenchmarks: %s", err)
+	}
+	for _, r := range results {
+		if err := postPerfResult(b.key, r); err != nil {
+			log.Printf("postPerfResult %s %s: %v", hash, r.Benchmark, err)
+		}
+	}
+
+	// Remember this workpath so a nearby future revision can reuse it.
+	if b.lastWorkpath != "" && b.lastWorkpath != workpath {
+		os.RemoveAll(b.lastWorkpath)
+	}
+	b.lastWorkpath = workpath
+	b.lastHash = hash
+	return nil
+}
+
+// benchWorkpath returns a workpath holding a go tree updated to hash,
+// reusing b.lastWorkpath via hg update when it is within
+// benchReuseDistance revisions of hash. It reports whether the
+// returned workpath is a fresh one that the caller owns.
+func (b *Builder) benchWorkpath(hash string) (workpath string, isNew bool, err error) {
+	vcs := mainVCS()
+
+	if b.lastWorkpath != "" && b.nearHash(b.lastHash, hash) {
+		if err := vcs.Update(filepath.Join(b.lastWorkpath, "go"), hash); err == nil {
+			return b.lastWorkpath, false, nil
+		}
+		// The cached workpath is unusable; fall through to a fresh clone.
+		os.RemoveAll(b.lastWorkpath)
+		b.lastWorkpath = ""
+	}
+
+	workpath = filepath.Join(*buildroot, b.name+"-bench-"+hash[:12])
+	if err := os.Mkdir(workpath, mkdirPerm); err != nil {
+		return "", false, err
+	}
+	goDir := filepath.Join(workpath, "go")
+	gorootMu.Lock()
+	err = vcs.Clone(goroot, goDir)
+	gorootMu.Unlock()
+	if err != nil {
+		return "", false, err
+	}
+	if err := vcs.Update(goDir, hash); err != nil {
+		return "", false, err
+	}
+	return workpath, true, nil
+}
+
+// buildGoTool runs *buildCmd in workpath, which must hold a "go" tree
+// already updated to the revision being measured. It is shared by
+// benchHash and bisectMetrics, both of which need a freshly-built
+// toolchain before they can benchmark a workpath, and by bisectTest,
+// which judges a revision by the build's exit status.
+func (b *Builder) buildGoTool(workpath string) (buildLog string, status int, runTime time.Duration, err error) {
+	srcDir := filepath.Join(workpath, "go", "src")
+	logfile := filepath.Join(workpath, "build.log")
+	cmd := *buildCmd
+	if !filepath.IsAbs(cmd) {
+		cmd = filepath.Join(srcDir, cmd)
+	}
+	startTime := time.Now()
+	buildLog, status, err = b.runBuild(*buildTimeout, workpath, srcDir, logfile, b.envv(), cmd)
+	runTime = time.Now().Sub(startTime)
+	return
+}
+
+// nearHash reports whether to is within benchReuseDistance revisions
+// of from in the main repository's history, making it cheap to reach
+// to from a workpath already updated to from.
+func (b *Builder) nearHash(from, to string) bool {
+	if from == "" || from == to {
+		return from == to
+	}
+	out, _, err := runLog(*cmdTimeout, nil, "", goroot,
+		hgCmd("log",
+			"--rev="+from+"::"+to+" or "+to+"::"+from,
+			"--template={node}\n")...,
+	)
+	if err != nil {
+		return false
+	}
+	n := len(strings.Fields(out))
+	return n > 0 && n <= benchReuseDistance
+}
+
+// benchList returns the packages to benchmark, as set by -benchpkgs.
+func benchList() []string {
+	if *benchPkgs == "" {
+		return nil
+	}
+	return strings.Split(*benchPkgs, ",")
+}
+
+var benchLineRe = regexp.MustCompile(`^(Benchmark\S+)\s+\d+\s+(.*)$`)
+var benchMetricRe = regexp.MustCompile(`([0-9.]+)\s+(ns/op|B/op|allocs/op)`)
+
+// runBenchmarks builds and runs "go test -bench" over the configured
+// packages, parsing testing.B output lines into PerfResults.
+func (b *Builder) runBenchmarks(workpath, hash string) ([]PerfResult, error) {
+	goTool := filepath.Join(workpath, "go", "bin", "go")
+	srcDir := filepath.Join(workpath, "go", "src")
+
+	var results []PerfResult
+	for _, pkg := range benchList() {
+		logfile := filepath.Join(workpath, "bench-"+strings.Replace(pkg, "/", "_", -1)+".log")
+		out, status, err := runLog(*buildTimeout, b.envv(), logfile, srcDir,
+			goTool, "test", "-run=NONE", "-bench=.", "-benchmem", pkg)
+		if err != nil {
+			return results, err
+		}
+		artifacts := []PerfArtifact{{Type: "log", Body: []byte(out)}}
+		if status != 0 {
+			results = append(results, PerfResult{
+				Builder:   b.name,
+				Hash:      hash,
+				Benchmark: pkg,
+				Artifacts: artifacts,
+			})
+			continue
+		}
+		for _, line := range strings.Split(out, "\n") {
+			m := benchLineRe.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			metrics := map[string]float64{}
+			for _, mm := range benchMetricRe.FindAllStringSubmatch(m[2], -1) {
+				if v, err := strconv.ParseFloat(mm[1], 64); err == nil {
+					metrics[mm[2]] = v
+				}
+			}
+			results = append(results, PerfResult{
+				Builder:   b.name,
+				Hash:      hash,
+				Benchmark: m[1],
+				Metrics:   metrics,
+				Artifacts: artifacts,
+			})
+		}
+	}
+	return results, nil
+}
+
+// BisectResult is the outcome of a bisection run: the culprit
+// revision, bracketed by the good and bad revisions that bounded the
+// search, along with enough metadata to identify it on the dashboard.
+type BisectResult struct {
+	Builder string
+	Good    string
+	Bad     string
+	Culprit string
+	Author  string
+	Desc    string
+}
+
+// bisect performs an hg-based binary search between -bisectgood (or,
+// if unset, this builder's last known-good revision on the
+// dashboard) and -bisectbad, narrowing the range on each step by
+// building (or, in -bench mode, benchmarking) the midpoint revision.
+// The identified culprit is posted to the dashboard and logged.
+func (b *Builder) bisect() error {
+	vcs := mainVCS()
+	bad, err := vcs.FullHash(goroot, *bisectBad)
+	if err != nil {
+		return fmt.Errorf("bisect: resolving bad revision %q: %v", *bisectBad, err)
+	}
+
+	good := *bisectGood
+	if good == "" {
+		good, err = b.lastGreen()
+		if err != nil {
+			return fmt.Errorf("bisect: finding last good revision: %v", err)
+		}
+	}
+	good, err = vcs.FullHash(goroot, good)
+	if err != nil {
+		return fmt.Errorf("bisect: resolving good revision %q: %v", *bisectGood, err)
+	}
+
+	revs, err := hgRevList(goroot, good, bad)
+	if err != nil {
+		return fmt.Errorf("bisect: %v", err)
+	}
+	if len(revs) < 2 {
+		return fmt.Errorf("bisect: no revisions between %s and %s", good, bad)
+	}
+
+	var baseline map[string]float64
+	if *benchMode {
+		baseline, err = b.bisectMetrics(revs[0])
+		if err != nil {
+			return fmt.Errorf("bisect: measuring baseline at %s: %v", revs[0], err)
+		}
+	}
+
+	// Binary search: revs[lo] is known good, revs[hi] is known bad.
+	lo, hi := 0, len(revs)-1
+	for lo+1 < hi {
+		mid := (lo + hi) / 2
+		ok, err := b.bisectTest(revs[mid], baseline)
+		if err != nil {
+			log.Printf("bisect %s: %v", revs[mid], err)
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	culprit := revs[hi]
+	l, err := hgLogOne(goroot, culprit)
+	if err != nil {
+		return fmt.Errorf("bisect: describing culprit %s: %v", culprit, err)
+	}
+
+	res := BisectResult{
+		Builder: b.name,
+		Good:    good,
+		Bad:     bad,
+		Culprit: culprit,
+		Author:  l.Author,
+		Desc:    l.Desc,
+	}
+	log.Printf("bisect %s: culprit is %s by %s: %s", b.name, culprit, l.Author, l.Desc)
+	if err := postBisectResult(b.key, res); err != nil {
+		log.Printf("postBisectResult: %v", err)
+	}
+	return nil
+}
+
+// bisectTest reports whether rev passes: in correctness mode, whether
+// the build succeeds; in -bench mode, whether the first benchmark's
+// ns/op at rev is not more than -bisectslower slower than baseline.
+func (b *Builder) bisectTest(rev string, baseline map[string]float64) (bool, error) {
+	if !*benchMode {
+		workpath, isNew, err := b.benchWorkpath(rev)
+		if err != nil {
+			return false, err
+		}
+		if isNew {
+			defer os.RemoveAll(workpath)
+		}
+		_, status, _, err := b.buildGoTool(workpath)
+		if err != nil {
+			return false, err
+		}
+		return status == 0, nil
+	}
+	metrics, err := b.bisectMetrics(rev)
+	if err != nil {
+		return false, err
+	}
+	if base := baseline["ns/op"]; base > 0 && (metrics["ns/op"]-base)/base > *bisectSlower {
+		return false, nil
+	}
+	return true, nil
+}
+
+// bisectMetrics runs the configured benchmarks at rev and returns the
+// first result's metrics, for comparison against a baseline.
+func (b *Builder) bisectMetrics(rev string) (map[string]float64, error) {
+	workpath, isNew, err := b.benchWorkpath(rev)
+	if err != nil {
+		return nil, err
+	}
+	if isNew {
+		defer os.RemoveAll(workpath)
+	}
+
+	// Build the toolchain at rev before benchmarking it: a reused
+	// workpath's go binary may be stale, and a freshly-cloned one has
+	// no go binary at all.
+	buildLog, status, _, err := b.buildGoTool(workpath)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", *buildCmd, err)
+	}
+	if status != 0 {
+		return nil, fmt.Errorf("%s: failed to build at %s:\n%s", *buildCmd, rev, buildLog)
+	}
+
+	results, err := b.runBenchmarks(workpath, rev)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no benchmark results at %s", rev)
+	}
+	return results[0].Metrics, nil
+}
+
+// lastGreen returns the most recent revision for which this builder
+// has a known-good result on the dashboard.
+func (b *Builder) lastGreen() (string, error) {
+	return dashboardLastGreen(b.name)
+}
+
+// hgRevList returns the revisions from good to bad (inclusive, good
+// first) along the linear ancestry between them.
+func hgRevList(root, good, bad string) ([]string, error) {
+	out, _, err := runLog(*cmdTimeout, nil, "", root,
+		hgCmd("log",
+			"--rev="+good+"::"+bad,
+			"--template={node}\n")...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// hgLogOne returns the Commit entry for a single revision.
+func hgLogOne(root, rev string) (*Commit, error) {
+	if l, ok := commits.Get("", rev); ok {
+		return l, nil
+	}
+	data, _, err := runLog(*cmdTimeout, nil, "", root,
+		hgCmd("log",
+			"--encoding=utf-8",
+			"--rev="+rev,
+			"--limit=1",
+			"--template="+xmlLogTemplate)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var logStruct struct {
+		Log []Commit
+	}
+	if err := xml.Unmarshal([]byte("<Top>"+data+"</Top>"), &logStruct); err != nil {
+		return nil, err
+	}
+	if len(logStruct.Log) == 0 {
+		return nil, fmt.Errorf("no such revision %s", rev)
+	}
+	return &logStruct.Log[0], nil
+}
+
 // failBuild checks for a new commit for this builder
 // and fails it if one is found.
 // It returns true if a build was "attempted".
@@ -372,7 +864,7 @@ func (b *Builder) buildSubrepo(goRoot, goPath, pkg, hash string) (string, error)
 	}
 
 	// fetch package and dependencies
-	log, status, err := runLog(*cmdTimeout, env, "", goPath, goTool, "get", "-d", pkg+"/...")
+	log, status, err := b.runBuild(*cmdTimeout, goPath, goPath, "", env, goTool, "get", "-d", pkg+"/...")
 	if err == nil && status != 0 {
 		err = fmt.Errorf("go exited with status %d", status)
 	}
@@ -380,20 +872,40 @@ func (b *Builder) buildSubrepo(goRoot, goPath, pkg, hash string) (string, error)
 		return log, err
 	}
 
-	// hg update to the specified hash
+	// update to the specified hash, in whichever VCS this package uses
 	pkgPath := filepath.Join(goPath, "src", pkg)
-	if err := run(*cmdTimeout, nil, pkgPath, hgCmd("update", hash)...); err != nil {
+	if err := vcsForPackage(pkg).Update(pkgPath, hash); err != nil {
 		return "", err
 	}
 
 	// test the package
-	log, status, err = runLog(*buildTimeout, env, "", goPath, goTool, "test", "-short", pkg+"/...")
+	log, status, err = b.runBuild(*buildTimeout, goPath, goPath, "", env, goTool, "test", "-short", pkg+"/...")
 	if err == nil && status != 0 {
 		err = fmt.Errorf("go exited with status %d", status)
 	}
 	return log, err
 }
 
+// runBuild runs a build or test command, transparently sandboxing it
+// in a container when -sandbox is set. workpath is bind-mounted into
+// the container read-write so the command can see (and modify) it at
+// the same path it runs at on the host.
+func (b *Builder) runBuild(timeout time.Duration, workpath, dir, logfile string, env []string, cmdAndArgs ...string) (string, int, error) {
+	if len(cmdAndArgs) == 0 {
+		return "", 0, fmt.Errorf("runBuild: no command given")
+	}
+	if sb := currentSandbox(); sb != nil {
+		out, status, err := sb.Run(timeout, b.sandboxImage(), []Mount{{Host: workpath, Container: workpath}}, env, dir, cmdAndArgs)
+		if logfile != "" {
+			if werr := ioutil.WriteFile(logfile, []byte(out), 0644); werr != nil {
+				log.Printf("runBuild: writing %s: %v", logfile, werr)
+			}
+		}
+		return out, status, err
+	}
+	return runLog(timeout, env, logfile, dir, cmdAndArgs...)
+}
+
 // envv returns an environment for build/bench execution
 func (b *Builder) envv() []string {
 	if runtime.GOOS == "windows" {
@@ -487,11 +999,10 @@ func commitWatcher() {
 	}
 }
 
+// hgClone clones url into path. Callers that clone from goroot itself
+// are responsible for holding gorootMu, the same as any other read of
+// the primary local goroot.
 func hgClone(url, path string) error {
-	if url == goroot {
-		gorootMu.Lock()
-		defer gorootMu.Unlock()
-	}
 	return run(*cmdTimeout, nil, *buildroot, hgCmd("clone", url, path)...)
 }
 
@@ -503,8 +1014,9 @@ func hgRepoExists(path string) bool {
 	return fi.IsDir()
 }
 
-// HgLog represents a single Mercurial revision.
-type HgLog struct {
+// Commit represents a single revision, normalized across VCS
+// backends by the VCS interface.
+type Commit struct {
 	Hash   string
 	Author string
 	Date   string
@@ -515,10 +1027,6 @@ type HgLog struct {
 	added bool
 }
 
-// logByHash is a cache of all Mercurial revisions we know about,
-// indexed by full hash.
-var logByHash = map[string]*HgLog{}
-
 // xmlLogTemplate is a template to pass to Mercurial to make
 // hg log print the log in valid XML for parsing with xml.Unmarshal.
 const xmlLogTemplate = `
@@ -531,16 +1039,19 @@ const xmlLogTemplate = `
 	</Log>
 `
 
-// commitPoll pulls any new revisions from the hg server
-// and tells the server about them.
+// commitPoll pulls any new revisions from the package's repository,
+// using whichever VCS backend it is tracked with, and tells the
+// dashboard about them.
 func commitPoll(key, pkg string) {
 	pkgRoot := goroot
+	vcs := mainVCS()
 
 	if pkg != "" {
 		pkgRoot = filepath.Join(*buildroot, pkg)
-		if !hgRepoExists(pkgRoot) {
-			if err := hgClone(repoURL(pkg), pkgRoot); err != nil {
-				log.Printf("%s: hg clone failed: %v", pkg, err)
+		vcs = vcsForPackage(pkg)
+		if !vcs.Exists(pkgRoot) {
+			if err := vcs.Clone(repoURL(pkg), pkgRoot); err != nil {
+				log.Printf("%s: clone failed: %v", pkg, err)
 				if err := os.RemoveAll(pkgRoot); err != nil {
 					log.Printf("%s: %v", pkg, err)
 				}
@@ -561,70 +1072,59 @@ func commitPoll(key, pkg string) {
 	}
 
 	lockGoroot()
-	err := run(*cmdTimeout, nil, pkgRoot, hgCmd("pull")...)
+	err := vcs.Pull(pkgRoot)
 	unlockGoroot()
 	if err != nil {
-		log.Printf("hg pull: %v", err)
+		log.Printf("%s: pull: %v", pkg, err)
 		return
 	}
 
-	const N = 50 // how many revisions to grab
+	// Grab the last N revisions, or, the first time we see this
+	// package, -historyDepth of them so we can backfill its history.
+	limit := N
+	if *historyDepth > limit && !commits.HasAny(pkg) {
+		limit = *historyDepth
+	}
 
 	lockGoroot()
-	data, _, err := runLog(*cmdTimeout, nil, "", pkgRoot, hgCmd("log",
-		"--encoding=utf-8",
-		"--limit="+strconv.Itoa(N),
-		"--template="+xmlLogTemplate)...,
-	)
+	logs, err := vcs.Log(pkgRoot, limit)
 	unlockGoroot()
 	if err != nil {
-		log.Printf("hg log: %v", err)
+		log.Printf("%s: log: %v", pkg, err)
 		return
 	}
 
-	var logStruct struct {
-		Log []HgLog
-	}
-	err = xml.Unmarshal([]byte("<Top>"+data+"</Top>"), &logStruct)
-	if err != nil {
-		log.Printf("unmarshal hg log: %v", err)
-		return
-	}
-
-	logs := logStruct.Log
-
-	// Pass 1.  Fill in parents and add new log entries to logsByHash.
-	// Empty parent means take parent from next log entry.
-	// Non-empty parent has form 1234:hashhashhash; we want full hash.
+	// Add new log entries to the commit cache.
 	for i := range logs {
 		l := &logs[i]
-		if l.Parent == "" && i+1 < len(logs) {
-			l.Parent = logs[i+1].Hash
-		} else if l.Parent != "" {
-			l.Parent, _ = fullHash(pkgRoot, l.Parent)
-		}
 		if *verbose {
-			log.Printf("hg log %s: %s < %s\n", pkg, l.Hash, l.Parent)
+			log.Printf("log %s: %s < %s\n", pkg, l.Hash, l.Parent)
 		}
-		if logByHash[l.Hash] == nil {
-			// Make copy to avoid pinning entire slice when only one entry is new.
-			t := *l
-			logByHash[t.Hash] = &t
+		if _, ok := commits.Get(pkg, l.Hash); !ok {
+			commits.Put(pkg, l)
 		}
 	}
 
 	for i := range logs {
-		l := &logs[i]
-		addCommit(pkg, l.Hash, key)
+		addCommit(pkg, logs[i].Hash, key)
+	}
+
+	if err := commits.Flush(); err != nil {
+		log.Printf("%s: saving commit cache: %v", pkg, err)
 	}
 }
 
+// N is how many revisions commitPoll grabs on a steady-state poll.
+const N = 50
+
 // addCommit adds the commit with the named hash to the dashboard.
 // key is the secret key for authentication to the dashboard.
-// It avoids duplicate effort.
+// It avoids duplicate effort, using the on-disk commit cache so that
+// restarting the builder doesn't forget which commits were already
+// added and re-post them.
 func addCommit(pkg, hash, key string) bool {
-	l := logByHash[hash]
-	if l == nil {
+	l, ok := commits.Get(pkg, hash)
+	if !ok {
 		return false
 	}
 	if l.added {
@@ -636,9 +1136,8 @@ func addCommit(pkg, hash, key string) bool {
 		log.Printf("%s already on dashboard\n", hash)
 		// Record that this hash is on the dashboard,
 		// as must be all its parents.
-		for l != nil {
-			l.added = true
-			l = logByHash[l.Parent]
+		for _, h := range append([]string{hash}, commits.Ancestors(pkg, hash)...) {
+			commits.MarkAdded(pkg, h)
 		}
 		return true
 	}
@@ -655,6 +1154,7 @@ func addCommit(pkg, hash, key string) bool {
 		log.Printf("failed to add %s to dashboard: %v", key, err)
 		return false
 	}
+	commits.MarkAdded(pkg, hash)
 	return true
 }
 
@@ -687,15 +1187,20 @@ func fullHash(root, rev string) (string, error) {
 }
 
 var repoRe = regexp.MustCompile(`^code\.google\.com/p/([a-z0-9\-]+(\.[a-z0-9\-]+)?)(/[a-z0-9A-Z_.\-/]+)?$`)
+var githubRe = regexp.MustCompile(`^github\.com/([a-zA-Z0-9\-_.]+)/([a-zA-Z0-9\-_.]+)(/[a-zA-Z0-9A-Z_.\-/]+)?$`)
 
 // repoURL returns the repository URL for the supplied import path.
+// Sub-repos that have moved off code.google.com to Git hosts are
+// recognized here too, so vcsForPackage can tell them apart.
 func repoURL(importPath string) string {
-	m := repoRe.FindStringSubmatch(importPath)
-	if len(m) < 2 {
-		log.Printf("repoURL: couldn't decipher %q", importPath)
-		return ""
+	if m := repoRe.FindStringSubmatch(importPath); len(m) >= 2 {
+		return "https://code.google.com/p/" + m[1]
+	}
+	if m := githubRe.FindStringSubmatch(importPath); len(m) >= 3 {
+		return "https://github.com/" + m[1] + "/" + m[2]
 	}
-	return "https://code.google.com/p/" + m[1]
+	log.Printf("repoURL: couldn't decipher %q", importPath)
+	return ""
 }
 
 // defaultSuffix returns file extension used for command files in
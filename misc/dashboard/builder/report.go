@@ -0,0 +1,146 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BuildReport is a structured account of a single buildHash run,
+// broken into the phases all.bash (or the equivalent build command)
+// printed "#####" markers for, so downstream tools can compute
+// per-package flakiness and per-phase timing without regex-scraping
+// the raw build log themselves.
+type BuildReport struct {
+	Builder  string
+	Hash     string
+	Status   int // exit status of the overall build command
+	Duration time.Duration
+	Phases   []BuildPhase
+}
+
+// BuildPhase is one "##### Foo." section of the build log, e.g.
+// "Building packages and commands" or "Testing packages".
+type BuildPhase struct {
+	Name     string
+	Status   int           // 0 if every package in this phase passed, 1 otherwise
+	Log      string        // this phase's excerpt of the raw build log
+	Duration time.Duration `json:",omitempty"` // set for phases timed directly, e.g. "clone" and "update"
+
+	Packages   []PackageResult    `json:",omitempty"`
+	Benchmarks []BenchMeasurement `json:",omitempty"`
+
+	logOffset int // byte offset of this phase's first line in rawLog
+}
+
+// PackageResult is one "ok  pkg  1.234s" or "FAIL  pkg  0.012s" line,
+// together with any "--- FAIL: TestFoo" lines that preceded it.
+type PackageResult struct {
+	Name        string
+	Status      string // "ok" or "FAIL"
+	Duration    time.Duration
+	FailedTests []string `json:",omitempty"`
+}
+
+// BenchMeasurement is one testing.B result line parsed from the log.
+type BenchMeasurement struct {
+	Name    string
+	Metrics map[string]float64
+}
+
+var (
+	phaseHeaderRe = regexp.MustCompile(`^##### (.+?)\.?$`)
+	pkgOkRe       = regexp.MustCompile(`^ok  \t(\S+)\t([0-9.]+)s`)
+	pkgFailRe     = regexp.MustCompile(`^FAIL\t(\S+)\t([0-9.]+)s`)
+	testFailRe    = regexp.MustCompile(`^--- FAIL: (\S+)`)
+)
+
+// parseBuildReport scans rawLog for phase markers, per-package test
+// results, failed-test names, and benchmark lines, producing a
+// BuildReport for it. Each phase's Log is an excerpt of rawLog, so the
+// report carries everything downstream tools need even when the raw
+// log itself isn't uploaded (as with -reportFormat=json).
+func parseBuildReport(builder, hash, rawLog string, status int, d time.Duration) *BuildReport {
+	report := &BuildReport{Builder: builder, Hash: hash, Status: status, Duration: d}
+
+	var cur *BuildPhase
+	closePhase := func(end int) {
+		if cur != nil {
+			cur.Log = rawLog[cur.logOffset:end]
+			report.Phases = append(report.Phases, *cur)
+		}
+	}
+
+	// pendingFails collects "--- FAIL: TestFoo" names as they're seen;
+	// go test prints them before the package's final ok/FAIL summary
+	// line, so they're attached to the *next* such line, not the
+	// previous package's.
+	var pendingFails []string
+
+	offset := 0
+	for _, line := range strings.SplitAfter(rawLog, "\n") {
+		trimmed := strings.TrimSuffix(line, "\n")
+
+		if m := phaseHeaderRe.FindStringSubmatch(trimmed); m != nil {
+			closePhase(offset)
+			cur = &BuildPhase{Name: m[1], logOffset: offset + len(line)}
+			pendingFails = nil
+			offset += len(line)
+			continue
+		}
+
+		if cur != nil {
+			switch {
+			case pkgOkRe.MatchString(trimmed):
+				m := pkgOkRe.FindStringSubmatch(trimmed)
+				cur.Packages = append(cur.Packages, PackageResult{
+					Name:        m[1],
+					Status:      "ok",
+					Duration:    parseSeconds(m[2]),
+					FailedTests: pendingFails,
+				})
+				pendingFails = nil
+			case pkgFailRe.MatchString(trimmed):
+				m := pkgFailRe.FindStringSubmatch(trimmed)
+				cur.Packages = append(cur.Packages, PackageResult{
+					Name:        m[1],
+					Status:      "FAIL",
+					Duration:    parseSeconds(m[2]),
+					FailedTests: pendingFails,
+				})
+				pendingFails = nil
+				cur.Status = 1
+			case testFailRe.MatchString(trimmed):
+				m := testFailRe.FindStringSubmatch(trimmed)
+				pendingFails = append(pendingFails, m[1])
+			case benchLineRe.MatchString(trimmed):
+				m := benchLineRe.FindStringSubmatch(trimmed)
+				metrics := map[string]float64{}
+				for _, mm := range benchMetricRe.FindAllStringSubmatch(m[2], -1) {
+					if v, err := strconv.ParseFloat(mm[1], 64); err == nil {
+						metrics[mm[2]] = v
+					}
+				}
+				cur.Benchmarks = append(cur.Benchmarks, BenchMeasurement{Name: m[1], Metrics: metrics})
+			}
+		}
+
+		offset += len(line)
+	}
+	closePhase(offset)
+
+	return report
+}
+
+func parseSeconds(s string) time.Duration {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(f * float64(time.Second))
+}
@@ -0,0 +1,47 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBuildReportFailedTests(t *testing.T) {
+	const log = `##### Testing packages.
+--- FAIL: TestFoo (0.00s)
+	foo_test.go:10: boom
+FAIL	pkg/foo	0.012s
+ok  	pkg/bar	0.034s
+--- FAIL: TestBaz (0.00s)
+	baz_test.go:20: kaboom
+--- FAIL: TestQux (0.00s)
+	baz_test.go:30: kaboom again
+FAIL	pkg/baz	0.056s
+`
+	report := parseBuildReport("linux-amd64", "deadbeef", log, 2, 0)
+	if len(report.Phases) != 1 {
+		t.Fatalf("got %d phases, want 1", len(report.Phases))
+	}
+	phase := report.Phases[0]
+
+	want := []PackageResult{
+		{Name: "pkg/foo", Status: "FAIL", FailedTests: []string{"TestFoo"}},
+		{Name: "pkg/bar", Status: "ok"},
+		{Name: "pkg/baz", Status: "FAIL", FailedTests: []string{"TestBaz", "TestQux"}},
+	}
+	if len(phase.Packages) != len(want) {
+		t.Fatalf("got %d packages, want %d: %+v", len(phase.Packages), len(want), phase.Packages)
+	}
+	for i, w := range want {
+		got := phase.Packages[i]
+		if got.Name != w.Name || got.Status != w.Status {
+			t.Errorf("package %d = %+v, want %+v", i, got, w)
+		}
+		if !reflect.DeepEqual(got.FailedTests, w.FailedTests) {
+			t.Errorf("package %d FailedTests = %v, want %v", i, got.FailedTests, w.FailedTests)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+// sandboxKind selects the container runtime used to isolate build
+// and test execution. "none" (the default) runs commands directly on
+// the host, as the builder always has.
+var sandboxKind = flag.String("sandbox", "none", `container runtime to isolate build execution ("docker", "podman", or "none")`)
+
+// Mount is a read-write bind mount passed into a sandboxed command.
+type Mount struct {
+	Host      string
+	Container string
+}
+
+// Sandbox runs a command inside an isolated container.
+type Sandbox interface {
+	Run(timeout time.Duration, image string, mounts []Mount, env []string, dir string, cmdAndArgs []string) (log string, status int, err error)
+}
+
+// currentSandbox returns the Sandbox selected by -sandbox, or nil if
+// sandboxing is disabled.
+func currentSandbox() Sandbox {
+	switch *sandboxKind {
+	case "docker":
+		return containerSandbox{bin: "docker"}
+	case "podman":
+		return containerSandbox{bin: "podman"}
+	default:
+		return nil
+	}
+}
+
+// builderImages maps a builder name to the container image used to
+// run its builds when sandboxing is enabled. Builders not listed use
+// defaultSandboxImage.
+var builderImages = map[string]string{
+	"linux-arm":     "golang-builder:arm",
+	"linux-arm64":   "golang-builder:arm64",
+	"linux-386":     "golang-builder:386",
+	"linux-amd64":   "golang-builder:amd64",
+	"nacl-amd64p32": "golang-builder:nacl",
+}
+
+const defaultSandboxImage = "golang-builder:amd64"
+
+// sandboxImage returns the container image to run b's builds in.
+func (b *Builder) sandboxImage() string {
+	if image, ok := builderImages[b.name]; ok {
+		return image
+	}
+	return defaultSandboxImage
+}
+
+// containerSandbox implements Sandbox by shelling out to a
+// docker-compatible CLI (docker or podman share a command surface).
+type containerSandbox struct {
+	bin string // "docker" or "podman"
+}
+
+func (s containerSandbox) Run(timeout time.Duration, image string, mounts []Mount, env []string, dir string, cmdAndArgs []string) (string, int, error) {
+	args := []string{"run", "--rm", "-w", dir}
+	for _, m := range mounts {
+		args = append(args, "-v", m.Host+":"+m.Container+":rw")
+	}
+	for _, e := range env {
+		args = append(args, "-e", e)
+	}
+	args = append(args, image)
+	args = append(args, cmdAndArgs...)
+	return runLog(timeout, nil, "", "", append([]string{s.bin}, args...)...)
+}
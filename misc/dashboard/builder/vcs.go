@@ -0,0 +1,196 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// VCS abstracts the version-control operations the builder needs, so
+// packages that live outside the main Mercurial tree (e.g. sub-repos
+// that have moved to Git hosts) can be tracked the same way as the
+// main Go repository.
+type VCS interface {
+	// Clone checks out a fresh copy of url into path.
+	Clone(url, path string) error
+	// Pull fetches new revisions into the repository rooted at path.
+	Pull(path string) error
+	// Update switches the working copy at path to rev.
+	Update(path, rev string) error
+	// FullHash resolves a (possibly abbreviated) revision to its full hash.
+	FullHash(path, rev string) (string, error)
+	// Log returns up to limit revisions of history, most recent first.
+	Log(path string, limit int) ([]Commit, error)
+	// Exists reports whether path already holds a checkout for this VCS.
+	Exists(path string) bool
+}
+
+// vcsKind selects the VCS backend for the main repository.
+var vcsKind = flag.String("vcs", "hg", `version control system for the main repository ("hg" or "git")`)
+
+// mainVCS returns the VCS backend configured for the main repository.
+func mainVCS() VCS {
+	return vcsNamed(*vcsKind)
+}
+
+// mainRepoURL returns the clone URL for the main Go repository, in
+// whichever VCS -vcs selects.
+func mainRepoURL() string {
+	if *vcsKind == "git" {
+		return gitUrl
+	}
+	return hgUrl
+}
+
+// vcsForPackage returns the VCS backend to use for the named
+// sub-repo package, inferred from its repository URL. This lets
+// sub-repos that have moved off code.google.com to Git hosts be
+// tracked without the rest of the builder caring.
+func vcsForPackage(pkg string) VCS {
+	return vcsForURL(repoURL(pkg))
+}
+
+func vcsNamed(name string) VCS {
+	if name == "git" {
+		return gitVCS{}
+	}
+	return hgVCS{}
+}
+
+func vcsForURL(url string) VCS {
+	if strings.HasSuffix(url, ".git") || strings.Contains(url, "github.com") {
+		return gitVCS{}
+	}
+	return hgVCS{}
+}
+
+// hgVCS implements VCS using the existing hg-specific helpers.
+type hgVCS struct{}
+
+func (hgVCS) Clone(url, path string) error {
+	return hgClone(url, path)
+}
+
+func (hgVCS) Pull(path string) error {
+	return run(*cmdTimeout, nil, path, hgCmd("pull")...)
+}
+
+func (hgVCS) Update(path, rev string) error {
+	return run(*cmdTimeout, nil, path, hgCmd("update", rev)...)
+}
+
+func (hgVCS) FullHash(path, rev string) (string, error) {
+	return fullHash(path, rev)
+}
+
+func (hgVCS) Exists(path string) bool {
+	return hgRepoExists(path)
+}
+
+func (hgVCS) Log(path string, limit int) ([]Commit, error) {
+	data, _, err := runLog(*cmdTimeout, nil, "", path, hgCmd("log",
+		"--encoding=utf-8",
+		"--limit="+strconv.Itoa(limit),
+		"--template="+xmlLogTemplate)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var logStruct struct {
+		Log []Commit
+	}
+	if err := xml.Unmarshal([]byte("<Top>"+data+"</Top>"), &logStruct); err != nil {
+		return nil, err
+	}
+
+	logs := logStruct.Log
+	// Empty parent means take parent from next log entry.
+	// Non-empty parent has form 1234:hashhashhash; we want the full hash.
+	for i := range logs {
+		l := &logs[i]
+		if l.Parent == "" && i+1 < len(logs) {
+			l.Parent = logs[i+1].Hash
+		} else if l.Parent != "" {
+			l.Parent, _ = fullHash(path, l.Parent)
+		}
+	}
+	return logs, nil
+}
+
+// gitVCS implements VCS by shelling out to git.
+type gitVCS struct{}
+
+func (gitVCS) Clone(url, path string) error {
+	return run(*cmdTimeout, nil, filepath.Dir(path), "git", "clone", url, path)
+}
+
+func (gitVCS) Pull(path string) error {
+	return run(*cmdTimeout, nil, path, "git", "fetch", "origin")
+}
+
+func (gitVCS) Update(path, rev string) error {
+	return run(*cmdTimeout, nil, path, "git", "checkout", rev)
+}
+
+func (gitVCS) FullHash(path, rev string) (string, error) {
+	s, _, err := runLog(*cmdTimeout, nil, "", path, "git", "rev-parse", rev)
+	if err != nil {
+		return "", err
+	}
+	s = strings.TrimSpace(s)
+	if len(s) != 40 {
+		return "", fmt.Errorf("git returned invalid hash %q", s)
+	}
+	return s, nil
+}
+
+func (gitVCS) Exists(path string) bool {
+	fi, err := os.Stat(filepath.Join(path, ".git"))
+	return err == nil && fi.IsDir()
+}
+
+// gitLogFormat emits one record per commit, fields separated by \x1f
+// and records separated by \x1e, so that commit messages containing
+// arbitrary text (including blank lines) parse unambiguously.
+const gitLogFormat = "%H%x1f%P%x1f%an <%ae>%x1f%aI%x1f%B%x1e"
+
+func (gitVCS) Log(path string, limit int) ([]Commit, error) {
+	out, _, err := runLog(*cmdTimeout, nil, "", path, "git", "log",
+		"origin/master", "-n", strconv.Itoa(limit), "--format="+gitLogFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []Commit
+	for _, rec := range strings.Split(out, "\x1e") {
+		rec = strings.TrimPrefix(rec, "\n")
+		if rec == "" {
+			continue
+		}
+		f := strings.SplitN(rec, "\x1f", 5)
+		if len(f) < 5 {
+			continue
+		}
+		parent := ""
+		if parents := strings.Fields(f[1]); len(parents) > 0 {
+			parent = parents[0]
+		}
+		commits = append(commits, Commit{
+			Hash:   f[0],
+			Parent: parent,
+			Author: f[2],
+			Date:   f[3],
+			Desc:   strings.TrimRight(f[4], "\n"),
+		})
+	}
+	return commits, nil
+}